@@ -0,0 +1,113 @@
+package buildcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+func writeImageConfig(t *testing.T, dir string, raw []byte, parent digest.Digest) digest.Digest {
+	t.Helper()
+	id := digest.FromBytes(raw)
+	contentPath := filepath.Join(dir, "imagedb/content/sha256", id.Hex())
+	if err := os.MkdirAll(filepath.Dir(contentPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(contentPath, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if parent != "" {
+		parentPath := filepath.Join(dir, "imagedb/metadata/sha256", id.Hex(), "parent")
+		if err := os.MkdirAll(filepath.Dir(parentPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(parentPath, []byte(parent.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return id
+}
+
+func TestGetParentChainOrderAndParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcache-chain-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootConfig := []byte(`{"rootfs":{"diff_ids":["sha256:` + strings.Repeat("a", 64) + `"]}}`)
+	rootID := writeImageConfig(t, dir, rootConfig, "")
+	childConfig := []byte(`{"rootfs":{"diff_ids":["sha256:` + strings.Repeat("a", 64) + `","sha256:` + strings.Repeat("b", 64) + `"]}}`)
+	childID := writeImageConfig(t, dir, childConfig, rootID)
+
+	b := &buildCache{}
+	imgs, err := b.getParentChain(context.Background(), dir, childID, defaultMaxDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 2 {
+		t.Fatalf("expected 2 images in chain, got %d", len(imgs))
+	}
+	if imgs[0].id != childID || imgs[1].id != rootID {
+		t.Fatalf("unexpected chain order: %v, %v", imgs[0].id, imgs[1].id)
+	}
+	if imgs[0].parent != rootID {
+		t.Fatalf("expected child's parent to be root, got %v", imgs[0].parent)
+	}
+}
+
+// TestGetParentChainCycle confirms a cycle in the on-disk "parent" linkage
+// (e.g. from a corrupt or maliciously crafted imagedb) is rejected instead
+// of looping forever.
+func TestGetParentChainCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcache-chain-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	aConfig := []byte(`{"rootfs":{"diff_ids":["sha256:` + strings.Repeat("a", 64) + `"]}}`)
+	bConfig := []byte(`{"rootfs":{"diff_ids":["sha256:` + strings.Repeat("b", 64) + `"]}}`)
+	aID := digest.FromBytes(aConfig)
+	bID := digest.FromBytes(bConfig)
+	writeImageConfig(t, dir, aConfig, bID)
+	writeImageConfig(t, dir, bConfig, aID)
+
+	b := &buildCache{}
+	if _, err := b.getParentChain(context.Background(), dir, aID, defaultMaxDepth); err == nil {
+		t.Fatal("expected an error for a cyclic parent chain, got nil")
+	} else if !strings.Contains(err.Error(), "cycle detected") {
+		t.Fatalf("expected a cycle-detected error, got %v", err)
+	}
+}
+
+// TestGetParentChainMaxDepth confirms a chain longer than maxDepth is
+// rejected rather than walked indefinitely.
+func TestGetParentChainMaxDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcache-chain-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var parent digest.Digest
+	var leaf digest.Digest
+	for i := 0; i < 5; i++ {
+		raw := []byte(fmt.Sprintf(`{"rootfs":{"diff_ids":["sha256:%064d"]}}`, i))
+		leaf = writeImageConfig(t, dir, raw, parent)
+		parent = leaf
+	}
+
+	b := &buildCache{}
+	if _, err := b.getParentChain(context.Background(), dir, leaf, 3); err == nil {
+		t.Fatal("expected an error for a chain exceeding maxDepth, got nil")
+	} else if !strings.Contains(err.Error(), "maximum depth") {
+		t.Fatalf("expected a maximum-depth error, got %v", err)
+	}
+}
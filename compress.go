@@ -0,0 +1,57 @@
+package buildcache
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// newCompressor wraps w with the compression o selects. The returned
+// writer must be closed to flush any trailing compressed data.
+func newCompressor(w io.Writer, o *getOptions) (io.WriteCloser, error) {
+	switch o.compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		if o.gzipLevel != nil {
+			return gzip.NewWriterLevel(w, *o.gzipLevel)
+		}
+		return gzip.NewWriter(w), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingWriter tracks cumulative bytes written through it and, if
+// progress is set, reports them against whichever entry is currently being
+// written. setEntry must be called before writing a new tar entry.
+type countingWriter struct {
+	w        io.Writer
+	progress ProgressFunc
+	total    int
+
+	name    string
+	index   int
+	written int64
+}
+
+func (c *countingWriter) setEntry(name string, index int) {
+	c.name = name
+	c.index = index
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	if c.progress != nil {
+		c.progress(c.name, c.index, c.total, c.written)
+	}
+	return n, err
+}
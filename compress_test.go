@@ -0,0 +1,144 @@
+package buildcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/context"
+)
+
+// TestWithGzipLevelNoCompression confirms gzip.NoCompression (0) is honored
+// rather than silently falling back to the default level, the mistake an
+// int-typed "unset means 0" sentinel made indistinguishable from an
+// explicit request for no compression.
+func TestWithGzipLevelNoCompression(t *testing.T) {
+	input := bytes.Repeat([]byte{0}, 64*1024)
+
+	var def bytes.Buffer
+	o := &getOptions{compression: CompressionGzip}
+	w, err := newCompressor(&def, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var none bytes.Buffer
+	o = &getOptions{compression: CompressionGzip}
+	WithGzipLevel(gzip.NoCompression)(o)
+	w, err = newCompressor(&none, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if none.Len() <= def.Len() {
+		t.Fatalf("expected gzip.NoCompression output (%d bytes) to be larger than default-level output (%d bytes) for highly compressible input", none.Len(), def.Len())
+	}
+}
+
+// TestNewCompressorZstdRoundTrip confirms CompressionZstd produces a stream
+// a zstd reader can decompress back to the original input, the one
+// Compression value compress_test.go didn't otherwise exercise.
+func TestNewCompressorZstdRoundTrip(t *testing.T) {
+	input := []byte("hello buildcache, this is a zstd round trip test")
+
+	var buf bytes.Buffer
+	w, err := newCompressor(&buf, &getOptions{compression: CompressionZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes()[:len(zstdMagic)], zstdMagic) {
+		t.Fatalf("expected output to start with the zstd magic bytes, got %x", buf.Bytes()[:len(zstdMagic)])
+	}
+
+	zr, err := zstd.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Fatalf("decompressed = %q, want %q", got, input)
+	}
+}
+
+// TestWriteCacheTarProgress confirms ProgressFunc fires for every archive
+// entry with the index/total describing its position and the cumulative
+// bytes written so far, the plumbing countingWriter exists for.
+func TestWriteCacheTarProgress(t *testing.T) {
+	rootConfig := []byte(`{"rootfs":{"diff_ids":[]}}`)
+	rootID := digest.FromBytes(rootConfig)
+	childConfig := []byte(`{"rootfs":{"diff_ids":[]},"child":true}`)
+	childID := digest.FromBytes(childConfig)
+	imgs := []image{
+		{raw: childConfig, id: childID, parent: rootID},
+		{raw: rootConfig, id: rootID},
+	}
+
+	type call struct {
+		name    string
+		index   int
+		total   int
+		written int64
+	}
+	var calls []call
+	o := &getOptions{
+		compression: CompressionNone,
+		progress: func(name string, index, total int, written int64) {
+			calls = append(calls, call{name, index, total, written})
+		},
+	}
+
+	pr := (&buildCache{}).writeCacheTar(context.Background(), &localLayerSource{graphdir: "", driverName: "vfs"}, imgs, o)
+	if _, err := ioutil.ReadAll(pr); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) == 0 {
+		t.Fatal("expected the progress callback to fire")
+	}
+	seen := map[string]bool{}
+	for _, c := range calls {
+		if c.total != 3 {
+			t.Fatalf("call %+v: total = %d, want 3 (2 configs + manifest.json)", c, c.total)
+		}
+		seen[c.name] = true
+	}
+	for _, name := range []string{childID.Hex() + ".json", rootID.Hex() + ".json", "manifest.json"} {
+		if !seen[name] {
+			t.Fatalf("expected a progress call for entry %q, got %+v", name, calls)
+		}
+	}
+
+	last := calls[len(calls)-1]
+	if last.name != "manifest.json" || last.index != 2 {
+		t.Fatalf("expected the final call to be for manifest.json at index 2, got %+v", last)
+	}
+	if last.written <= 0 {
+		t.Fatalf("expected cumulative written bytes > 0, got %d", last.written)
+	}
+}
@@ -2,7 +2,6 @@ package buildcache
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,7 +24,12 @@ func New(client *engineapi.Client) *buildCache {
 	}
 }
 
-func (b *buildCache) Get(ctx context.Context, graphdir, image string) (io.ReadCloser, error) {
+func (b *buildCache) Get(ctx context.Context, graphdir, image string, opts ...Option) (io.ReadCloser, error) {
+	o := &getOptions{format: FormatDocker, maxDepth: defaultMaxDepth, compression: CompressionGzip}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	id, err := b.getImageID(ctx, image)
 	if err != nil {
 		return nil, err
@@ -39,32 +43,92 @@ func (b *buildCache) Get(ctx context.Context, graphdir, image string) (io.ReadCl
 	}
 	imagedir := filepath.Join(graphdir, "image", info.Driver)
 
-	if _, err := os.Stat(filepath.Join(imagedir, "imagedb/content/sha256", id.Hex())); err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("Could not access files from the Docker storage directory %v. This application currently requires direct access to this directory for saving build cache. Use \"--graph\" option to specify different folder.", graphdir)
-		}
-	}
-	pc, err := b.getParentChain(ctx, imagedir, id)
+	pc, src, err := b.getChain(ctx, graphdir, imagedir, info.Driver, id, o.maxDepth)
 	if err != nil {
 		return nil, err
 	}
 	if err := validateParentChain(pc); err != nil {
+		src.Close()
 		return nil, err
 	}
 
-	return b.writeCacheTar(ctx, pc), nil
+	switch o.format {
+	case FormatOCI:
+		return b.writeOCITar(ctx, src, pc, o), nil
+	default:
+		return b.writeCacheTar(ctx, src, pc, o), nil
+	}
 }
 
-func (b *buildCache) writeCacheTar(ctx context.Context, imgs []image) io.ReadCloser {
+// getChain resolves the parent chain for id and picks the layerSource its
+// blobs should be read from. When the daemon's API is new enough to report
+// parent linkage (remoteParentLinkageSupported), it walks the chain and
+// reads every layer purely over the engine API, via getParentChainRemote
+// and newRemoteLayerSource, without ever touching imagedir — the point of
+// this path is to work against remote daemons, rootless setups and Docker
+// Desktop, none of which expose a local graphdir. imagedir is only stat'd,
+// and only required to exist, on the older-daemon fallback path below,
+// which walks the on-disk "parent" linkage file and reads layer blobs via
+// the graph driver directly.
+func (b *buildCache) getChain(ctx context.Context, graphdir, imagedir, driverName string, id digest.Digest, maxDepth int) ([]image, layerSource, error) {
+	if sv, err := b.client.ServerVersion(ctx); err == nil && remoteParentLinkageSupported(sv.APIVersion) {
+		imgs, err := b.getParentChainRemote(ctx, id, maxDepth)
+		if err != nil {
+			return nil, nil, err
+		}
+		src, err := newRemoteLayerSource(ctx, b.client, imgs)
+		if err != nil {
+			return nil, nil, err
+		}
+		return imgs, src, nil
+	}
+
+	if _, err := os.Stat(filepath.Join(imagedir, "imagedb/content/sha256", id.Hex())); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("Could not access files from the Docker storage directory %v. This application currently requires direct access to this directory for saving build cache. Use \"--graph\" option to specify different folder.", graphdir)
+		}
+		return nil, nil, err
+	}
+	imgs, err := b.getParentChain(ctx, imagedir, id, maxDepth)
+	if err != nil {
+		return nil, nil, err
+	}
+	return imgs, &localLayerSource{graphdir: graphdir, driverName: driverName}, nil
+}
+
+func (b *buildCache) writeCacheTar(ctx context.Context, src layerSource, imgs []image, o *getOptions) io.ReadCloser {
 	pr, pw := io.Pipe()
 	go func() {
-		gz := gzip.NewWriter(pw)
-		archive := tar.NewWriter(gz)
+		defer src.Close()
+		total := len(imgs) + 1 // configs + manifest.json
+		seen := map[digest.Digest]struct{}{}
+		for _, img := range imgs {
+			for _, diffID := range img.layers {
+				if _, ok := seen[diffID]; !ok {
+					seen[diffID] = struct{}{}
+					total++
+				}
+			}
+		}
+
+		comp, err := newCompressor(pw, o)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		cw := &countingWriter{w: comp, progress: o.progress, total: total}
+		archive := tar.NewWriter(cw)
+
+		written := map[digest.Digest]struct{}{}
 		var mfst []manifestRow
+		index := 0
 		for _, img := range imgs {
 			if ctx.Err() != nil {
 				pw.CloseWithError(ctx.Err())
+				return
 			}
+			cw.setEntry(img.id.Hex()+".json", index)
+			index++
 			if err := archive.WriteHeader(&tar.Header{
 				Name: img.id.Hex() + ".json",
 				Size: int64(len(img.raw)),
@@ -77,10 +141,31 @@ func (b *buildCache) writeCacheTar(ctx context.Context, imgs []image) io.ReadClo
 				pw.CloseWithError(err)
 				return
 			}
+
+			chainIDs := chainIDsFromDiffIDs(img.layers)
+			layerPaths := make([]string, len(img.layers))
+			for i, diffID := range img.layers {
+				layerPaths[i] = diffID.Hex() + "/layer.tar"
+				if _, ok := written[diffID]; ok {
+					continue
+				}
+				cw.setEntry(layerPaths[i], index)
+				index++
+				var parentChainID digest.Digest
+				if i > 0 {
+					parentChainID = chainIDs[i-1]
+				}
+				if err := writeLayerTar(archive, src, diffID, chainIDs[i], parentChainID); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				written[diffID] = struct{}{}
+			}
+
 			mfst = append(mfst, manifestRow{
 				Config: img.id.Hex() + ".json",
 				Parent: img.parent.String(),
-				Layers: img.layers,
+				Layers: layerPaths,
 			})
 		}
 		mfstData, err := json.Marshal(mfst)
@@ -88,6 +173,7 @@ func (b *buildCache) writeCacheTar(ctx context.Context, imgs []image) io.ReadClo
 			pw.CloseWithError(err)
 			return
 		}
+		cw.setEntry("manifest.json", index)
 		if err := archive.WriteHeader(&tar.Header{
 			Name: "manifest.json",
 			Size: int64(len(mfstData)),
@@ -104,7 +190,7 @@ func (b *buildCache) writeCacheTar(ctx context.Context, imgs []image) io.ReadClo
 			pw.CloseWithError(err)
 			return
 		}
-		if err := gz.Close(); err != nil {
+		if err := comp.Close(); err != nil {
 			pw.CloseWithError(err)
 			return
 		}
@@ -125,43 +211,60 @@ func (b *buildCache) getImageID(ctx context.Context, ref string) (digest.Digest,
 	return digest.ParseDigest(inspect.ID)
 }
 
-func (b *buildCache) getParentChain(ctx context.Context, dir string, id digest.Digest) ([]image, error) {
-	config, err := ioutil.ReadFile(filepath.Join(dir, "imagedb/content/sha256", id.Hex()))
-	if err := ctx.Err(); err != nil {
-		return nil, err
-	}
-	if err != nil {
-		return nil, err
-	}
-	img, err := parseImage(config)
-	if err != nil {
-		return nil, err
-	}
-	if img.id != id {
-		return nil, fmt.Errorf("invalid configuration for %v, got id %v", id, img.id)
-	}
-	parent, err := ioutil.ReadFile(filepath.Join(dir, "imagedb/metadata/sha256", id.Hex(), "parent"))
-	if err := ctx.Err(); err != nil {
-		return nil, err
-	}
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []image{*img}, nil
+// getParentChain walks from id up through its ancestors, returning the
+// chain ordered from id (most layers) to its root (fewest). It walks
+// iteratively rather than recursively so a corrupt or maliciously crafted
+// "parent" file that cycles can't blow the stack, and enforces maxDepth so
+// a very deep chain can't be used to exhaust memory either. Since the walk
+// already visits ancestors in the order the chain needs, appending as it
+// goes produces the right order directly; no prepend or final reverse is
+// needed.
+func (b *buildCache) getParentChain(ctx context.Context, dir string, id digest.Digest, maxDepth int) ([]image, error) {
+	visited := map[digest.Digest]struct{}{}
+	var imgs []image
+
+	cur := id
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := visited[cur]; ok {
+			return nil, fmt.Errorf("cycle detected in parent chain at %v", cur)
+		}
+		visited[cur] = struct{}{}
+		if len(imgs) >= maxDepth {
+			return nil, fmt.Errorf("parent chain for %v exceeds maximum depth of %d", id, maxDepth)
 		}
-		return nil, err
-	}
 
-	parentID, err := digest.ParseDigest(string(parent))
-	if err != nil {
-		return nil, err
-	}
-	img.parent = parentID
+		config, err := ioutil.ReadFile(filepath.Join(dir, "imagedb/content/sha256", cur.Hex()))
+		if err != nil {
+			return nil, err
+		}
+		img, err := parseImage(config)
+		if err != nil {
+			return nil, err
+		}
+		if img.id != cur {
+			return nil, fmt.Errorf("invalid configuration for %v, got id %v", cur, img.id)
+		}
 
-	pc, err := b.getParentChain(ctx, dir, parentID)
-	if err != nil {
-		return nil, err
+		parent, err := ioutil.ReadFile(filepath.Join(dir, "imagedb/metadata/sha256", cur.Hex(), "parent"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				imgs = append(imgs, *img)
+				return imgs, nil
+			}
+			return nil, err
+		}
+
+		parentID, err := digest.ParseDigest(string(parent))
+		if err != nil {
+			return nil, err
+		}
+		img.parent = parentID
+		imgs = append(imgs, *img)
+		cur = parentID
 	}
-	return append([]image{*img}, pc...), nil
 }
 
 type image struct {
@@ -174,7 +277,7 @@ type image struct {
 type manifestRow struct {
 	Config string
 	Parent string `json:",omitempty"`
-	Layers []digest.Digest
+	Layers []string
 }
 
 func parseImage(in []byte) (*image, error) {
@@ -200,6 +303,12 @@ func validateParentChain(imgs []image) error {
 	if err := validateParentChain(imgs[1:]); err != nil {
 		return err
 	}
+	// imgs comes from Get's own walk for a chain produced locally, but Put
+	// feeds it manifest.json/index.json rows straight from the input tar,
+	// so a parent can't be assumed to have no more layers than its child.
+	if len(imgs[1].layers) > len(imgs[0].layers) {
+		return fmt.Errorf("invalid layers in parent chain")
+	}
 	for i, l := range imgs[1].layers {
 		if l != imgs[0].layers[i] {
 			return fmt.Errorf("invalid layers in parent chain")
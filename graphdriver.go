@@ -0,0 +1,110 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/daemon/graphdriver"
+	_ "github.com/docker/docker/daemon/graphdriver/register"
+)
+
+// layerSource supplies the uncompressed layer diffs writeCacheTar and
+// writeOCITar write into the archive, so they don't have to care whether a
+// chain came from the local graphdir or purely over the engine API. size is
+// the exact length of rc's stream: writeLayerBlob uses it as the tar
+// header's size.
+type layerSource interface {
+	layerReader(diffID, chainID, parentChainID digest.Digest) (rc io.ReadCloser, size int64, err error)
+	io.Closer
+}
+
+// localLayerSource reads layer diffs directly from the graph driver under
+// graphdir, the way this package always did before getChain learned to
+// prefer the engine API.
+type localLayerSource struct {
+	graphdir, driverName string
+}
+
+func (s *localLayerSource) layerReader(diffID, chainID, parentChainID digest.Digest) (io.ReadCloser, int64, error) {
+	imagedir := filepath.Join(s.graphdir, "image", s.driverName)
+	size, err := layerDiffSize(imagedir, chainID)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, err := layerDiffReader(s.graphdir, s.driverName, chainID, parentChainID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, size, nil
+}
+
+func (s *localLayerSource) Close() error { return nil }
+
+// cacheID reads the graph driver id the daemon recorded for the layer at
+// chainID.
+func cacheID(imagedir string, chainID digest.Digest) (string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(imagedir, "layerdb/sha256", chainID.Hex(), "cache-id"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// layerDiffReader opens the uncompressed tar diff the graph driver recorded
+// for the layer at chainID. The resulting stream hashes to diffID, which is
+// why it can be written out verbatim as <diffID>/layer.tar. parentChainID
+// must be the chain ID of chainID's immediate parent, or "" if chainID is a
+// base layer: several graph drivers (aufs, devicemapper, vfs, btrfs, zfs)
+// don't isolate each layer's diff on disk and use the parent argument to
+// compute the incremental diff rather than the full merged filesystem.
+func layerDiffReader(graphdir, driverName string, chainID, parentChainID digest.Digest) (io.ReadCloser, error) {
+	imagedir := filepath.Join(graphdir, "image", driverName)
+	id, err := cacheID(imagedir, chainID)
+	if err != nil {
+		return nil, err
+	}
+	var parentID string
+	if parentChainID != "" {
+		parentID, err = cacheID(imagedir, parentChainID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	drv, err := graphdriver.New(filepath.Join(graphdir, driverName), driverName, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return drv.Diff(id, parentID)
+}
+
+// writeLayerBlob streams the layer identified by diffID/chainID from src
+// into archive as name. parentChainID is "" for a base layer.
+func writeLayerBlob(archive *tar.Writer, src layerSource, diffID, chainID, parentChainID digest.Digest, name string) error {
+	rc, size, err := src.layerReader(diffID, chainID, parentChainID)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := archive.WriteHeader(&tar.Header{
+		Name: name,
+		Size: size,
+		Mode: 0444,
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, rc)
+	return err
+}
+
+// writeLayerTar appends the layer identified by diffID/chainID to archive
+// as <diffID>/layer.tar, the path docker save expects under manifest.json's
+// Layers entries. parentChainID is "" for a base layer.
+func writeLayerTar(archive *tar.Writer, src layerSource, diffID, chainID, parentChainID digest.Digest) error {
+	return writeLayerBlob(archive, src, diffID, chainID, parentChainID, diffID.Hex()+"/layer.tar")
+}
@@ -0,0 +1,151 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/daemon/graphdriver"
+	_ "github.com/docker/docker/daemon/graphdriver/register"
+)
+
+// newVFSLayer creates (or, for a child layer, snapshots from parentCacheID)
+// a layer under drv, mounts it and writes files into it before unmounting
+// it again. The vfs driver is used because it needs no privileges and,
+// unlike most real drivers, stores each layer as a plain directory tree,
+// making it the natural choice for exercising the graph driver path in a
+// test.
+func newVFSLayer(t *testing.T, drv graphdriver.Driver, cacheID, parentCacheID string, files map[string]string) {
+	t.Helper()
+	if err := drv.Create(cacheID, parentCacheID, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := drv.Get(cacheID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := drv.Put(cacheID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordLayerdb writes the layerdb/sha256/<chainID>/{cache-id,size} files
+// the daemon would have recorded for a layer, which cacheID and
+// layerDiffSize read back.
+func recordLayerdb(t *testing.T, imagedir string, chainID digest.Digest, cacheID string, size int64) {
+	t.Helper()
+	dir := filepath.Join(imagedir, "layerdb/sha256", chainID.Hex())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cache-id"), []byte(cacheID), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "size"), []byte(strconv.FormatInt(size, 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func driverDiff(t *testing.T, drv graphdriver.Driver, id, parent string) []byte {
+	t.Helper()
+	rc, err := drv.Diff(id, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func tarEntries(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(data))
+	out := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[hdr.Name] = body
+	}
+	return out
+}
+
+// TestWriteLayerTarVFS exercises writeLayerTar and layerDiffReader against a
+// real vfs-backed graph driver instead of the layer-less images most other
+// tests in this package use to avoid standing one up. It confirms the bytes
+// written for <diffID>/layer.tar are exactly the driver's own Diff output,
+// both for a base layer (no parent) and for a layer diffed against its
+// parent's cache id.
+func TestWriteLayerTarVFS(t *testing.T) {
+	graphdir, err := ioutil.TempDir("", "buildcache-graphdriver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(graphdir)
+
+	const driverName = "vfs"
+	drv, err := graphdriver.New(filepath.Join(graphdir, driverName), driverName, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newVFSLayer(t, drv, "base-cache-id", "", map[string]string{"base.txt": "base"})
+	newVFSLayer(t, drv, "child-cache-id", "base-cache-id", map[string]string{"child.txt": "child"})
+
+	wantBase := driverDiff(t, drv, "base-cache-id", "")
+	wantChild := driverDiff(t, drv, "child-cache-id", "base-cache-id")
+
+	imagedir := filepath.Join(graphdir, "image", driverName)
+	baseChainID := digest.FromBytes([]byte("base-chain"))
+	childChainID := digest.FromBytes([]byte("child-chain"))
+	recordLayerdb(t, imagedir, baseChainID, "base-cache-id", int64(len(wantBase)))
+	recordLayerdb(t, imagedir, childChainID, "child-cache-id", int64(len(wantChild)))
+
+	src := &localLayerSource{graphdir: graphdir, driverName: driverName}
+	defer src.Close()
+
+	baseDiffID := digest.FromBytes([]byte("base-diffid"))
+	childDiffID := digest.FromBytes([]byte("child-diffid"))
+
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	if err := writeLayerTar(archive, src, baseDiffID, baseChainID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLayerTar(archive, src, childDiffID, childChainID, baseChainID); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := tarEntries(t, buf.Bytes())
+	if gotBase := got[baseDiffID.Hex()+"/layer.tar"]; !bytes.Equal(gotBase, wantBase) {
+		t.Fatalf("base layer bytes = %q, want %q", gotBase, wantBase)
+	}
+	if gotChild := got[childDiffID.Hex()+"/layer.tar"]; !bytes.Equal(gotChild, wantChild) {
+		t.Fatalf("child layer bytes = %q, want %q", gotChild, wantChild)
+	}
+}
@@ -0,0 +1,37 @@
+package buildcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+)
+
+// chainIDsFromDiffIDs computes the v1.1 chain ID for every prefix of
+// diffIDs, the same algorithm the daemon uses to key layerdb/sha256.
+func chainIDsFromDiffIDs(diffIDs []digest.Digest) []digest.Digest {
+	chain := make([]digest.Digest, len(diffIDs))
+	for i, d := range diffIDs {
+		if i == 0 {
+			chain[i] = d
+			continue
+		}
+		chain[i] = digest.FromBytes([]byte(chain[i-1].String() + " " + d.String()))
+	}
+	return chain
+}
+
+// layerDiffSize returns the uncompressed size the daemon recorded for the
+// layer diff at chainID. It returns an error if no size was recorded.
+func layerDiffSize(imagedir string, chainID digest.Digest) (int64, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(imagedir, "layerdb/sha256", chainID.Hex(), "size"))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	if _, err := fmt.Sscanf(string(raw), "%d", &size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,133 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/daemon/graphdriver"
+	engineapi "github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// TestGetPutOCIRoundTrip exercises the FormatOCI path end to end, the
+// counterpart of TestPutRoundTrip for the docker format: a real two-image
+// parent chain, with real vfs-backed layer blobs, is written out via
+// Get(..., WithFormat(FormatOCI)) and fed back into Put. It confirms the
+// parent annotation reconstructs the chain's parent linkage and that the
+// base layer, referenced by both images' manifests, is written to the tar
+// only once.
+func TestGetPutOCIRoundTrip(t *testing.T) {
+	graphdir, err := ioutil.TempDir("", "buildcache-oci-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(graphdir)
+
+	const driverName = "vfs"
+	drv, err := graphdriver.New(filepath.Join(graphdir, driverName), driverName, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newVFSLayer(t, drv, "base-cache-id", "", map[string]string{"base.txt": "base"})
+	newVFSLayer(t, drv, "child-cache-id", "base-cache-id", map[string]string{"child.txt": "child"})
+
+	baseDiffID := digest.FromBytes([]byte("oci-base-diffid"))
+	childDiffID := digest.FromBytes([]byte("oci-child-diffid"))
+	chainIDs := chainIDsFromDiffIDs([]digest.Digest{baseDiffID, childDiffID})
+
+	imagedir := filepath.Join(graphdir, "image", driverName)
+	recordLayerdb(t, imagedir, chainIDs[0], "base-cache-id", 0)
+	recordLayerdb(t, imagedir, chainIDs[1], "child-cache-id", 0)
+
+	rootConfig := []byte(`{"rootfs":{"diff_ids":["` + baseDiffID.String() + `"]}}`)
+	childConfig := []byte(`{"rootfs":{"diff_ids":["` + baseDiffID.String() + `","` + childDiffID.String() + `"]}}`)
+	rootID := writeImageConfig(t, imagedir, rootConfig, "")
+	childID := writeImageConfig(t, imagedir, childConfig, rootID)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get resolves the image reference to its id over the API first.
+		if r.URL.Path == "/images/"+childID.String()+"/json" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"Id":"`+childID.String()+`"}`)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, "/info") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"Driver":"`+driverName+`"}`)
+	}))
+	defer srv.Close()
+	cli, err := engineapi.NewClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(cli)
+
+	pr, err := b.Get(context.Background(), graphdir, childID.String(), WithFormat(FormatOCI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ociData, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstGraphdir, err := ioutil.TempDir("", "buildcache-oci-put-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstGraphdir)
+
+	if err := b.Put(context.Background(), dstGraphdir, bytes.NewReader(ociData)); err != nil {
+		t.Fatal(err)
+	}
+
+	dstImagedir := filepath.Join(dstGraphdir, "image", driverName)
+	for id, want := range map[digest.Digest][]byte{rootID: rootConfig, childID: childConfig} {
+		got, err := ioutil.ReadFile(filepath.Join(dstImagedir, "imagedb/content/sha256", id.Hex()))
+		if err != nil {
+			t.Fatalf("reading installed config for %v: %v", id, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("installed config for %v = %q, want %q", id, got, want)
+		}
+	}
+	parent, err := ioutil.ReadFile(filepath.Join(dstImagedir, "imagedb/metadata/sha256", childID.Hex(), "parent"))
+	if err != nil {
+		t.Fatalf("reading installed parent link: %v", err)
+	}
+	if string(parent) != rootID.String() {
+		t.Fatalf("installed parent = %v, want %v", string(parent), rootID)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(ociData))
+	blobCount := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(hdr.Name, "blobs/sha256/") {
+			blobCount++
+		}
+	}
+	// 2 configs + 2 manifests + 2 layer blobs (base, child): the base layer
+	// is referenced by both images' manifests but written only once.
+	if blobCount != 6 {
+		t.Fatalf("expected 6 content-addressed blobs, got %d", blobCount)
+	}
+}
@@ -0,0 +1,248 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+const (
+	mediaTypeImageConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	// mediaTypeImageLayerGzip is gzip-compressed: most OCI-consuming tools
+	// expect a layer blob's digest to match exactly what's stored, i.e. the
+	// compressed bytes, not the uncompressed diffID the graph driver's Diff
+	// hashes to. See writeCompressedLayerBlob.
+	mediaTypeImageLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	ociLayoutVersion = "1.0.0"
+
+	// ociAnnotationParent records the parent image's digest on a manifest
+	// so Put can reconstruct the same parent chain Get walked to build it.
+	ociAnnotationParent = "io.tonistiigi.buildcache.parent"
+)
+
+type ociDescriptor struct {
+	MediaType string        `json:"mediaType"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// writeOCITar writes imgs as an OCI image-layout: one image manifest per
+// image in the parent chain, each referencing a config and layer
+// descriptors, tied together by a top-level index.json. Layer blobs are
+// streamed from src the same way writeCacheTar streams them for the docker
+// format, so every blob a manifest references actually exists in the tar.
+//
+// Unlike writeCacheTar, the outer tar here is never compressed: o.compression
+// and o.gzipLevel only apply to FormatDocker (see WithCompression), since an
+// OCI image-layout's layer blobs are already individually gzip-compressed
+// (see writeCompressedLayerBlob) and most OCI-consuming tools expect the
+// layout tar itself to be a plain, uncompressed container for them. o.progress
+// is honored the same way it is for FormatDocker.
+func (b *buildCache) writeOCITar(ctx context.Context, src layerSource, imgs []image, o *getOptions) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		total := len(imgs)*2 + 2 // config + manifest blob per image, plus index.json and oci-layout
+		seen := map[digest.Digest]struct{}{}
+		for _, img := range imgs {
+			for _, diffID := range img.layers {
+				if _, ok := seen[diffID]; !ok {
+					seen[diffID] = struct{}{}
+					total++
+				}
+			}
+		}
+
+		cw := &countingWriter{w: pw, progress: o.progress, total: total}
+		archive := tar.NewWriter(cw)
+		index := 0
+		writeEntry := func(name string, data []byte) error {
+			cw.setEntry(name, index)
+			index++
+			if err := archive.WriteHeader(&tar.Header{
+				Name: name,
+				Size: int64(len(data)),
+				Mode: 0444,
+			}); err != nil {
+				return err
+			}
+			_, err := archive.Write(data)
+			return err
+		}
+
+		layerDescs := map[digest.Digest]ociDescriptor{}
+		var manifests []ociDescriptor
+		for _, img := range imgs {
+			if ctx.Err() != nil {
+				pw.CloseWithError(ctx.Err())
+				return
+			}
+
+			configDigest := digest.FromBytes(img.raw)
+			if err := writeEntry(filepath.Join("blobs/sha256", configDigest.Hex()), img.raw); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			chainIDs := chainIDsFromDiffIDs(img.layers)
+			layers := make([]ociDescriptor, len(img.layers))
+			for i, diffID := range img.layers {
+				if desc, ok := layerDescs[diffID]; ok {
+					layers[i] = desc
+					continue
+				}
+				var parentChainID digest.Digest
+				if i > 0 {
+					parentChainID = chainIDs[i-1]
+				}
+				cw.setEntry(diffID.String(), index)
+				index++
+				desc, err := writeCompressedLayerBlob(archive, src, diffID, chainIDs[i], parentChainID)
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				layerDescs[diffID] = desc
+				layers[i] = desc
+			}
+
+			var annotations map[string]string
+			if img.parent != "" {
+				annotations = map[string]string{ociAnnotationParent: img.parent.String()}
+			}
+
+			mfst := ociManifest{
+				SchemaVersion: 2,
+				Config: ociDescriptor{
+					MediaType: mediaTypeImageConfig,
+					Digest:    configDigest,
+					Size:      int64(len(img.raw)),
+				},
+				Layers:      layers,
+				Annotations: annotations,
+			}
+			mfstData, err := json.Marshal(mfst)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			mfstDigest := digest.FromBytes(mfstData)
+			if err := writeEntry(filepath.Join("blobs/sha256", mfstDigest.Hex()), mfstData); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			manifests = append(manifests, ociDescriptor{
+				MediaType: mediaTypeImageManifest,
+				Digest:    mfstDigest,
+				Size:      int64(len(mfstData)),
+			})
+		}
+
+		idxData, err := json.Marshal(ociIndex{SchemaVersion: 2, Manifests: manifests})
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := writeEntry("index.json", idxData); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := writeEntry("oci-layout", []byte(`{"imageLayoutVersion":"`+ociLayoutVersion+`"}`)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := archive.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+	go func() {
+		<-ctx.Done()
+		pw.CloseWithError(ctx.Err())
+	}()
+	return pr
+}
+
+// writeCompressedLayerBlob gzip-compresses the layer identified by
+// diffID/chainID, read from src, and writes it into archive as a
+// content-addressed OCI blob, digested and named by the compressed bytes
+// rather than by chainID's uncompressed diffID. A tar header needs the
+// entry's size up front, and the compressed size isn't known until
+// compression finishes, so the blob is spooled to a temp file first; this
+// keeps memory use bounded to metadata size, the same trade-off Put makes
+// for the same reason.
+func writeCompressedLayerBlob(archive *tar.Writer, src layerSource, diffID, chainID, parentChainID digest.Digest) (ociDescriptor, error) {
+	rc, _, err := src.layerReader(diffID, chainID, parentChainID)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile("", "buildcache-layer-")
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, h))
+	if _, err := io.Copy(gz, rc); err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := gz.Close(); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	compressedDigest := digest.Digest(fmt.Sprintf("sha256:%x", h.Sum(nil)))
+	if err := archive.WriteHeader(&tar.Header{
+		Name: filepath.Join("blobs/sha256", compressedDigest.Hex()),
+		Size: size,
+		Mode: 0444,
+	}); err != nil {
+		return ociDescriptor{}, err
+	}
+	if _, err := io.Copy(archive, tmp); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	return ociDescriptor{
+		MediaType: mediaTypeImageLayerGzip,
+		Digest:    compressedDigest,
+		Size:      size,
+	}, nil
+}
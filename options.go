@@ -0,0 +1,90 @@
+package buildcache
+
+// Format selects the archive layout produced by Get.
+type Format int
+
+const (
+	// FormatDocker is the docker-save style layout: manifest.json plus
+	// per-image <id>.json configs. This is the default for backwards
+	// compatibility.
+	FormatDocker Format = iota
+	// FormatOCI produces an OCI image-layout tar: oci-layout, index.json
+	// and content-addressed blobs under blobs/sha256/<digest>.
+	FormatOCI
+)
+
+// defaultMaxDepth bounds how many ancestors Get will walk, matching
+// Docker's historical 127-layer limit with headroom.
+const defaultMaxDepth = 256
+
+// Compression selects how writeCacheTar compresses the archive stream.
+type Compression int
+
+const (
+	// CompressionGzip is the default, backwards-compatible compression.
+	CompressionGzip Compression = iota
+	// CompressionNone writes a plain, uncompressed tar.
+	CompressionNone
+	// CompressionZstd trades a little cross-tool compatibility for a
+	// large speed/ratio win over gzip, particularly on image blobs.
+	CompressionZstd
+)
+
+// ProgressFunc is invoked as the archive is written: name is the entry
+// currently being written (for an OCI layer blob, whose entry name depends
+// on its compressed digest, the layer's diffID instead), index/total
+// describe its position among all entries, and written is the cumulative
+// number of tar bytes emitted so far, counted before any compression.
+type ProgressFunc func(name string, index, total int, written int64)
+
+type getOptions struct {
+	format      Format
+	maxDepth    int
+	compression Compression
+	gzipLevel   *int
+	progress    ProgressFunc
+}
+
+// Option configures the behavior of Get.
+type Option func(*getOptions)
+
+// WithFormat selects the output format for Get. It defaults to FormatDocker.
+func WithFormat(f Format) Option {
+	return func(o *getOptions) {
+		o.format = f
+	}
+}
+
+// WithMaxDepth overrides how many ancestors Get will walk before giving up
+// with an error. It defaults to defaultMaxDepth.
+func WithMaxDepth(n int) Option {
+	return func(o *getOptions) {
+		o.maxDepth = n
+	}
+}
+
+// WithCompression selects the archive's compression. It defaults to
+// CompressionGzip and only affects FormatDocker output.
+func WithCompression(c Compression) Option {
+	return func(o *getOptions) {
+		o.compression = c
+	}
+}
+
+// WithGzipLevel sets the compression level used when compression is
+// CompressionGzip, including gzip.NoCompression. It defaults to
+// gzip.DefaultCompression and, like WithCompression, only affects
+// FormatDocker output.
+func WithGzipLevel(level int) Option {
+	return func(o *getOptions) {
+		o.gzipLevel = &level
+	}
+}
+
+// WithProgress registers a callback invoked as entries are written to the
+// archive, useful for reporting progress on multi-GB caches.
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *getOptions) {
+		o.progress = fn
+	}
+}
@@ -0,0 +1,336 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/context"
+)
+
+// Put reads a cache archive produced by Get, in either FormatDocker or
+// FormatOCI, and installs its image configs into the daemon's image store
+// under graphdir. It is the symmetric counterpart of Get: one job can Get
+// a cache tar and another, possibly on a different host, can Put it back
+// to warm its own daemon before building.
+//
+// Docker-format tars carry full layer blobs alongside the configs (see
+// writeCacheTar), so r can be multi-GB. Put spools it to a temp file and
+// makes several seekable passes over it, each reading only the handful of
+// small JSON entries it currently needs and discarding everything else
+// without buffering it, so peak memory stays proportional to metadata size
+// rather than image size.
+func (b *buildCache) Put(ctx context.Context, graphdir string, r io.Reader) error {
+	info, err := b.client.Info(ctx)
+	if err != nil {
+		return err
+	}
+	if graphdir == "" {
+		graphdir = info.DockerRootDir
+	}
+	imagedir := filepath.Join(graphdir, "image", info.Driver)
+
+	tmp, err := spoolToTempFile(r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	top, err := readNamedEntries(tmp, "manifest.json", "index.json", "oci-layout")
+	if err != nil {
+		return err
+	}
+
+	var imgs []image
+	if _, ok := top["oci-layout"]; ok {
+		imgs, err = parseOCIEntries(tmp, top["index.json"])
+	} else {
+		imgs, err = parseDockerEntries(tmp, top["manifest.json"])
+	}
+	if err != nil {
+		return err
+	}
+	if err := validateParentChain(imgs); err != nil {
+		return err
+	}
+
+	for _, img := range imgs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := putImage(imagedir, img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spoolToTempFile copies r to a temp file and returns it, so later passes
+// over it can seek back to the start instead of re-reading r, which may
+// not be seekable itself.
+func spoolToTempFile(r io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile("", "buildcache-put-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// readNamedEntries seeks f to the start and reads only the regular files
+// named in names into memory, keyed by path. Every other entry, including
+// a docker-format tar's <diffID>/layer.tar blobs, is drained with
+// io.Copy(ioutil.Discard, ...) rather than buffered.
+func readNamedEntries(f *os.File, names ...string) (map[string][]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	want := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		want[name] = struct{}{}
+	}
+
+	tr, closer, err := newTarReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	entries := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, ok := want[hdr.Name]; !ok {
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries[hdr.Name] = data
+	}
+	return entries, nil
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// newTarReader opens a tar reader over f, transparently decompressing if f
+// starts with a gzip or zstd header — the two compressions Get can produce
+// (see Compression in options.go). The returned closer, non-nil for either
+// compressed case, must be closed once the caller is done reading.
+func newTarReader(f *os.File) (*tar.Reader, io.Closer, error) {
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), gz, nil
+	case len(magic) == 4 && bytes.Equal(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), zstdCloser{zr}, nil
+	default:
+		return tar.NewReader(br), nil, nil
+	}
+}
+
+// zstdCloser adapts zstd.Decoder's Close, which returns nothing, to
+// io.Closer.
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+func parseDockerEntries(tmp *os.File, mfstData []byte) ([]image, error) {
+	if mfstData == nil {
+		return nil, fmt.Errorf("not a valid cache tar: missing manifest.json")
+	}
+	var mfst []manifestRow
+	if err := json.Unmarshal(mfstData, &mfst); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(mfst))
+	for i, row := range mfst {
+		names[i] = row.Config
+	}
+	configs, err := readNamedEntries(tmp, names...)
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := make([]image, len(mfst))
+	for i, row := range mfst {
+		raw, ok := configs[row.Config]
+		if !ok {
+			return nil, fmt.Errorf("not a valid cache tar: missing config %v", row.Config)
+		}
+		img, err := parseImage(raw)
+		if err != nil {
+			return nil, err
+		}
+		if row.Parent != "" {
+			parent, err := digest.ParseDigest(row.Parent)
+			if err != nil {
+				return nil, err
+			}
+			img.parent = parent
+		}
+		imgs[i] = *img
+	}
+	return imgs, nil
+}
+
+func parseOCIEntries(tmp *os.File, idxData []byte) ([]image, error) {
+	if idxData == nil {
+		return nil, fmt.Errorf("not a valid OCI layout: missing index.json")
+	}
+	var idx ociIndex
+	if err := json.Unmarshal(idxData, &idx); err != nil {
+		return nil, err
+	}
+
+	mfstNames := make([]string, len(idx.Manifests))
+	for i, d := range idx.Manifests {
+		mfstNames[i] = filepath.Join("blobs/sha256", d.Digest.Hex())
+	}
+	mfstBlobs, err := readNamedEntries(tmp, mfstNames...)
+	if err != nil {
+		return nil, err
+	}
+
+	mfsts := make([]ociManifest, len(idx.Manifests))
+	configNames := make([]string, len(idx.Manifests))
+	for i, d := range idx.Manifests {
+		data, ok := mfstBlobs[mfstNames[i]]
+		if !ok {
+			return nil, fmt.Errorf("not a valid OCI layout: missing manifest blob %v", d.Digest)
+		}
+		if err := json.Unmarshal(data, &mfsts[i]); err != nil {
+			return nil, err
+		}
+		configNames[i] = filepath.Join("blobs/sha256", mfsts[i].Config.Digest.Hex())
+	}
+
+	configBlobs, err := readNamedEntries(tmp, configNames...)
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := make([]image, len(idx.Manifests))
+	for i, mfst := range mfsts {
+		raw, ok := configBlobs[configNames[i]]
+		if !ok {
+			return nil, fmt.Errorf("not a valid OCI layout: missing config blob %v", mfst.Config.Digest)
+		}
+		img, err := parseImage(raw)
+		if err != nil {
+			return nil, err
+		}
+		if parent := mfst.Annotations[ociAnnotationParent]; parent != "" {
+			parentID, err := digest.ParseDigest(parent)
+			if err != nil {
+				return nil, err
+			}
+			img.parent = parentID
+		}
+		imgs[i] = *img
+	}
+	return imgs, nil
+}
+
+// putImage installs img's config into imagedb/content and records its
+// parent in imagedb/metadata, refusing to overwrite an existing id whose
+// bytes differ from what's already on disk.
+func putImage(imagedir string, img image) error {
+	contentPath := filepath.Join(imagedir, "imagedb/content/sha256", img.id.Hex())
+	if existing, err := ioutil.ReadFile(contentPath); err == nil {
+		if string(existing) != string(img.raw) {
+			return fmt.Errorf("refusing to overwrite existing image %v with different content", img.id)
+		}
+		return writeParent(imagedir, img)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := atomicWriteFile(contentPath, img.raw); err != nil {
+		return err
+	}
+	return writeParent(imagedir, img)
+}
+
+func writeParent(imagedir string, img image) error {
+	if img.parent == "" {
+		return nil
+	}
+	parentPath := filepath.Join(imagedir, "imagedb/metadata/sha256", img.id.Hex(), "parent")
+	if existing, err := ioutil.ReadFile(parentPath); err == nil {
+		if string(existing) != img.parent.String() {
+			return fmt.Errorf("refusing to overwrite existing image %v with a different parent", img.id)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return atomicWriteFile(parentPath, []byte(img.parent.String()))
+}
+
+func atomicWriteFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
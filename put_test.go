@@ -0,0 +1,181 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	engineapi "github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// TestPutRoundTrip feeds writeCacheTar's own output back into Put and
+// confirms it lands in the daemon's image store the way Get found it:
+// same config bytes under imagedb/content, same parent linkage under
+// imagedb/metadata.
+func TestPutRoundTrip(t *testing.T) {
+	rootConfig := []byte(`{"rootfs":{"diff_ids":[]}}`)
+	rootID := digest.FromBytes(rootConfig)
+	// Keep configs distinct but still layer-less, so writeCacheTar never
+	// needs a real graph driver to resolve a layer blob.
+	childConfig := []byte(`{"rootfs":{"diff_ids":[]},"child":true}`)
+	childID := digest.FromBytes(childConfig)
+
+	imgs := []image{
+		{raw: childConfig, id: childID, parent: rootID},
+		{raw: rootConfig, id: rootID},
+	}
+
+	pr := (&buildCache{}).writeCacheTar(context.Background(), &localLayerSource{graphdir: "", driverName: "vfs"}, imgs, &getOptions{compression: CompressionNone})
+	data, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/info") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"Driver":"vfs"}`)
+	}))
+	defer srv.Close()
+	cli, err := engineapi.NewClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &buildCache{client: cli}
+
+	graphdir, err := ioutil.TempDir("", "buildcache-put-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(graphdir)
+
+	if err := b.Put(context.Background(), graphdir, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	imagedir := filepath.Join(graphdir, "image", "vfs")
+	for id, want := range map[digest.Digest][]byte{childID: childConfig, rootID: rootConfig} {
+		got, err := ioutil.ReadFile(filepath.Join(imagedir, "imagedb/content/sha256", id.Hex()))
+		if err != nil {
+			t.Fatalf("reading installed config for %v: %v", id, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("installed config for %v = %q, want %q", id, got, want)
+		}
+	}
+
+	parent, err := ioutil.ReadFile(filepath.Join(imagedir, "imagedb/metadata/sha256", childID.Hex(), "parent"))
+	if err != nil {
+		t.Fatalf("reading installed parent link: %v", err)
+	}
+	if string(parent) != rootID.String() {
+		t.Fatalf("installed parent = %v, want %v", string(parent), rootID)
+	}
+	if _, err := os.Stat(filepath.Join(imagedir, "imagedb/metadata/sha256", rootID.Hex(), "parent")); !os.IsNotExist(err) {
+		t.Fatalf("expected no parent file for root image, got err %v", err)
+	}
+}
+
+// TestPutRefusesConflictingOverwrite confirms Put refuses to overwrite an
+// existing image id whose stored config or parent differs from what the
+// input tar claims, rather than silently rewriting the daemon's real store.
+func TestPutRefusesConflictingOverwrite(t *testing.T) {
+	graphdir, err := ioutil.TempDir("", "buildcache-put-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(graphdir)
+	imagedir := filepath.Join(graphdir, "image", "vfs")
+
+	config := []byte(`{"rootfs":{"diff_ids":[]}}`)
+	id := digest.FromBytes(config)
+	realParent := digest.FromBytes([]byte(`{"rootfs":{"diff_ids":[]},"real":true}`))
+	if err := atomicWriteFile(filepath.Join(imagedir, "imagedb/content/sha256", id.Hex()), config); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicWriteFile(filepath.Join(imagedir, "imagedb/metadata/sha256", id.Hex(), "parent"), []byte(realParent.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	forgedParent := digest.FromBytes([]byte(`{"rootfs":{"diff_ids":[]},"forged":true}`))
+	if err := putImage(imagedir, image{raw: config, id: id, parent: forgedParent}); err == nil {
+		t.Fatal("expected an error overwriting an existing image's parent with a different one, got nil")
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(imagedir, "imagedb/metadata/sha256", id.Hex(), "parent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != realParent.String() {
+		t.Fatalf("parent link was overwritten: got %v, want %v", string(got), realParent)
+	}
+}
+
+// TestPutMalformedParentChain confirms a manifest.json whose rows aren't in
+// non-increasing layer-count order is rejected with an error instead of
+// panicking on an out-of-range index in validateParentChain.
+func TestPutMalformedParentChain(t *testing.T) {
+	shortConfig := []byte(`{"rootfs":{"diff_ids":["sha256:` + strings.Repeat("a", 64) + `"]}}`)
+	longConfig := []byte(`{"rootfs":{"diff_ids":["sha256:` + strings.Repeat("a", 64) + `","sha256:` + strings.Repeat("b", 64) + `"]}}`)
+
+	mfst := []manifestRow{
+		{Config: "short.json"},
+		{Config: "long.json"},
+	}
+	mfstData, err := json.Marshal(mfst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"manifest.json": mfstData,
+		"short.json":    shortConfig,
+		"long.json":     longConfig,
+	} {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Size: int64(len(data)), Mode: 0444}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"Driver":"vfs"}`)
+	}))
+	defer srv.Close()
+	cli, err := engineapi.NewClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &buildCache{client: cli}
+
+	graphdir, err := ioutil.TempDir("", "buildcache-put-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(graphdir)
+
+	if err := b.Put(context.Background(), graphdir, &buf); err == nil {
+		t.Fatal("expected an error for a malformed parent chain, got nil")
+	}
+}
@@ -0,0 +1,117 @@
+package buildcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// minAPIVersionForParent is the first engine API version whose image
+// inspect response reliably populates Parent, the field
+// getParentChainRemote depends on to walk ancestry without touching the
+// graphdir.
+const minAPIVersionForParent = "1.21"
+
+// remoteParentLinkageSupported reports whether the daemon's API exposes
+// enough information to walk a parent chain purely over the API.
+func remoteParentLinkageSupported(apiVersion string) bool {
+	return compareAPIVersions(apiVersion, minAPIVersionForParent) >= 0
+}
+
+func compareAPIVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// imageInspect is the subset of the engine API's ImageInspect response (the
+// body ImageInspectWithRaw returns) getParentChainRemote needs. Its shape
+// ({"Id":..., "Parent":..., "RootFS":{"Layers":[...]}}) is not the on-disk
+// image config's shape ({"rootfs":{"diff_ids":[...]}}) parseImage expects,
+// so the two can't share a decoder: an earlier version of this code fed
+// ImageInspectWithRaw's raw body straight into parseImage and it silently
+// failed to find any layers on every call.
+type imageInspect struct {
+	ID     string `json:"Id"`
+	Parent string `json:"Parent"`
+	RootFS struct {
+		Layers []digest.Digest `json:"Layers"`
+	} `json:"RootFS"`
+}
+
+// getParentChainRemote reconstructs the parent chain for id purely over the
+// engine API: it trusts ImageInspectWithRaw's Parent field for ancestry and
+// its RootFS.Layers for the image's diffIDs, instead of reading imagedir's
+// "parent" linkage file and on-disk config the way getParentChain does. It
+// mirrors getParentChain's iterative, cycle-safe, depth-capped walk in
+// every other respect.
+//
+// Each image's raw field is set to the engine API's own inspect body, not
+// the on-disk config bytes getParentChain would have read for the same
+// image: the API exposes no endpoint that returns those on-disk bytes
+// verbatim, so a tar built from a remote-walked chain carries the API's
+// representation of each config rather than a byte-identical copy of it.
+// That's enough for Put's round trip (it reads layers/parent back out the
+// same way) but, unlike a tar built from a local chain, it should not be
+// assumed to be bit-identical to what "docker save" would have produced.
+func (b *buildCache) getParentChainRemote(ctx context.Context, id digest.Digest, maxDepth int) ([]image, error) {
+	visited := map[digest.Digest]struct{}{}
+	var imgs []image
+
+	cur := id
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := visited[cur]; ok {
+			return nil, fmt.Errorf("cycle detected in parent chain at %v", cur)
+		}
+		visited[cur] = struct{}{}
+		if len(imgs) >= maxDepth {
+			return nil, fmt.Errorf("parent chain for %v exceeds maximum depth of %d", id, maxDepth)
+		}
+
+		_, raw, err := b.client.ImageInspectWithRaw(ctx, cur.String(), false)
+		if err != nil {
+			return nil, err
+		}
+		var inspect imageInspect
+		if err := json.Unmarshal(raw, &inspect); err != nil {
+			return nil, err
+		}
+		if inspect.ID != cur.String() {
+			return nil, fmt.Errorf("invalid configuration for %v, got id %v", cur, inspect.ID)
+		}
+		img := image{raw: raw, id: cur, layers: inspect.RootFS.Layers}
+
+		if inspect.Parent == "" {
+			imgs = append(imgs, img)
+			return imgs, nil
+		}
+		parentID, err := digest.ParseDigest(inspect.Parent)
+		if err != nil {
+			return nil, err
+		}
+		img.parent = parentID
+		imgs = append(imgs, img)
+		cur = parentID
+	}
+}
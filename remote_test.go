@@ -0,0 +1,72 @@
+package buildcache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	engineapi "github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// TestGetParentChainRemote exercises getParentChainRemote against a fixture
+// ImageInspect response shaped the way the engine API actually returns it
+// ({"Id":..., "RootFS":{"Layers":[...]}, ...}), which is not the shape
+// parseImage expects ({"rootfs":{"diff_ids":[...]}}). A prior version of
+// this code fed ImageInspectWithRaw's raw body straight into parseImage and
+// failed this way on every call. It also confirms the walk never touches
+// the filesystem: no imagedir is created or passed in at all.
+func TestGetParentChainRemote(t *testing.T) {
+	rootID := digest.FromBytes([]byte("root"))
+	childID := digest.FromBytes([]byte("child"))
+
+	// Fixture ImageInspect bodies, in the real API response shape, keyed by
+	// the image reference the request path carries (ImageInspectWithRaw is
+	// called with cur.String(), e.g. "sha256:<hex>").
+	inspects := map[string]string{
+		rootID.String(): `{"Id":"` + rootID.String() + `","Parent":"","RootFS":{"Type":"layers","Layers":["sha256:` +
+			strings.Repeat("a", 64) + `"]}}`,
+		childID.String(): `{"Id":"` + childID.String() + `","Parent":"` + rootID.String() + `","RootFS":{"Type":"layers","Layers":["sha256:` +
+			strings.Repeat("a", 64) + `","sha256:` + strings.Repeat("b", 64) + `"]}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		body, ok := inspects[ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	cli, err := engineapi.NewClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &buildCache{client: cli}
+
+	imgs, err := b.getParentChainRemote(context.Background(), childID, defaultMaxDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 2 {
+		t.Fatalf("expected 2 images in chain, got %d", len(imgs))
+	}
+	if imgs[0].id != childID || imgs[1].id != rootID {
+		t.Fatalf("unexpected chain order: %v, %v", imgs[0].id, imgs[1].id)
+	}
+	if len(imgs[0].layers) != 2 || len(imgs[1].layers) != 1 {
+		t.Fatalf("unexpected layer counts: %v, %v", imgs[0].layers, imgs[1].layers)
+	}
+	if imgs[0].parent != rootID {
+		t.Fatalf("expected child's parent to be root, got %v", imgs[0].parent)
+	}
+	if imgs[1].parent != "" {
+		t.Fatalf("expected root to have no parent, got %v", imgs[1].parent)
+	}
+}
@@ -0,0 +1,122 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/distribution/digest"
+	engineapi "github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// remoteLayerSource serves layer diffs out of the daemon's own "docker
+// save" stream for imgs[0] (the chain's topmost image), fetched once via
+// ImageSave, instead of reading them off a local graphdir. ImageSave asks
+// the daemon to build the exact bytes it would write for "docker save"
+// from its real on-disk storage and stream them over the API, including
+// every ancestor's layer blobs, so this can simply read back out of that
+// stream rather than re-deriving anything from the graph driver.
+//
+// A layer's diffID is shared by every image in the chain that includes it,
+// so looking the save stream's manifest.json up once by diffID (rather
+// than by chainID, which the daemon's own manifest doesn't use) is enough
+// to serve every image's layers, not just the topmost one's.
+type remoteLayerSource struct {
+	tmp      *os.File
+	byDiffID map[digest.Digest]string
+}
+
+func newRemoteLayerSource(ctx context.Context, client *engineapi.Client, imgs []image) (*remoteLayerSource, error) {
+	if len(imgs) == 0 {
+		return &remoteLayerSource{byDiffID: map[digest.Digest]string{}}, nil
+	}
+	top := imgs[0]
+
+	rc, err := client.ImageSave(ctx, []string{top.id.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	tmp, err := spoolToTempFile(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	byDiffID, err := parseSaveStreamLayers(tmp, top)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &remoteLayerSource{tmp: tmp, byDiffID: byDiffID}, nil
+}
+
+// parseSaveStreamLayers reads tmp's manifest.json and maps each of top's
+// diffIDs to the layer's path inside the save stream.
+func parseSaveStreamLayers(tmp *os.File, top image) (map[digest.Digest]string, error) {
+	entries, err := readNamedEntries(tmp, "manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	mfstData, ok := entries["manifest.json"]
+	if !ok {
+		return nil, fmt.Errorf("daemon's save stream for %v did not include manifest.json", top.id)
+	}
+	var mfst []manifestRow
+	if err := json.Unmarshal(mfstData, &mfst); err != nil {
+		return nil, err
+	}
+	if len(mfst) != 1 || len(mfst[0].Layers) != len(top.layers) {
+		return nil, fmt.Errorf("daemon's save stream for %v has an unexpected shape", top.id)
+	}
+
+	byDiffID := make(map[digest.Digest]string, len(top.layers))
+	for i, diffID := range top.layers {
+		byDiffID[diffID] = mfst[0].Layers[i]
+	}
+	return byDiffID, nil
+}
+
+// layerReader implements layerSource. chainID and parentChainID are
+// ignored: the save stream is keyed by diffID, not by graph-driver chain
+// id.
+func (s *remoteLayerSource) layerReader(diffID, chainID, parentChainID digest.Digest) (io.ReadCloser, int64, error) {
+	path, ok := s.byDiffID[diffID]
+	if !ok {
+		return nil, 0, fmt.Errorf("layer %v not present in the daemon's save stream", diffID)
+	}
+	if _, err := s.tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	tr := tar.NewReader(bufio.NewReader(s.tmp))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, 0, fmt.Errorf("layer %v (%v) not found in the daemon's save stream", diffID, path)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if hdr.Name != path {
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		return ioutil.NopCloser(tr), hdr.Size, nil
+	}
+}
+
+func (s *remoteLayerSource) Close() error {
+	if s.tmp == nil {
+		return nil
+	}
+	name := s.tmp.Name()
+	s.tmp.Close()
+	return os.Remove(name)
+}
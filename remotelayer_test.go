@@ -0,0 +1,91 @@
+package buildcache
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	engineapi "github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// TestRemoteLayerSource confirms layer blobs are read back out of the
+// daemon's own "docker save" stream (as ImageSave would return it) rather
+// than off a local graphdir, keyed by diffID so every image in the chain
+// that shares a layer can find it.
+func TestRemoteLayerSource(t *testing.T) {
+	diffID := digest.FromBytes([]byte("layer"))
+	layerData := []byte("layer contents")
+	top := image{id: digest.FromBytes([]byte("top")), layers: []digest.Digest{diffID}}
+
+	mfst := []manifestRow{{Config: top.id.Hex() + ".json", Layers: []string{diffID.Hex() + "/layer.tar"}}}
+	mfstData, err := json.Marshal(mfst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saveStream bytes.Buffer
+	archive := tar.NewWriter(&saveStream)
+	for name, data := range map[string][]byte{
+		"manifest.json":             mfstData,
+		diffID.Hex() + "/layer.tar": layerData,
+	} {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Size: int64(len(data)), Mode: 0444}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/images/get") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Write(saveStream.Bytes())
+	}))
+	defer srv.Close()
+
+	cli, err := engineapi.NewClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := newRemoteLayerSource(context.Background(), cli, []image{top})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	rc, size, err := src.layerReader(diffID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if size != int64(len(layerData)) {
+		t.Fatalf("expected size %d, got %d", len(layerData), size)
+	}
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, layerData) {
+		t.Fatalf("layer contents = %q, want %q", got, layerData)
+	}
+
+	if _, _, err := src.layerReader(digest.FromBytes([]byte("missing")), "", ""); err == nil {
+		t.Fatal("expected an error for a diffID not present in the save stream, got nil")
+	}
+}